@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CmdConfigCmd registers "config" as a direnv subcommand, the same way
+// every other builtin lives in cmd.go's AvailableCommands. It's declared
+// here rather than there because cmd.go isn't part of this change.
+var CmdConfigCmd = &Command{
+	Name: "config",
+	Desc: "Prints the effective, merged TOML configuration",
+	Args: []string{"dump"},
+	Fn:   CmdConfig,
+}
+
+func init() {
+	AvailableCommands = append(AvailableCommands, CmdConfigCmd)
+}
+
+// CmdConfig implements `direnv config <subcommand>`.
+func CmdConfig(env Env, args []string) (err error) {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: direnv config dump")
+	}
+
+	switch args[1] {
+	case "dump":
+		return cmdConfigDump(env)
+	default:
+		return fmt.Errorf("direnv config: unknown subcommand %q", args[1])
+	}
+}
+
+// cmdConfigDump prints the effective, merged TOML configuration, with each
+// key annotated by the file that set it. This is meant to let users debug
+// a stack of `.direnv.toml` layers and `include`d fragments.
+func cmdConfigDump(env Env) error {
+	config, err := LoadConfig(env)
+	if err != nil {
+		return err
+	}
+
+	origin := originForKeys(config.configLayers)
+	values := flattenTomlValues("", config.mergedToml)
+
+	keys := make([]string, 0, len(origin))
+	for key := range origin {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Printf("%s = %#v  # from %s\n", key, values[key], origin[key])
+	}
+
+	return nil
+}
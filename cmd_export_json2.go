@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// CmdExportJSON2 implements `direnv export json2`: it emits the structured
+// ExportEnvelope (added/removed/changed vars, watched files, diagnostics,
+// timing) instead of shell `export`/`unset` statements, so editors,
+// LSP-adjacent tooling and pkg/directclient can consume direnv's state
+// without parsing shell. With no .envrc loaded it prints an envelope with
+// no added, removed or changed vars rather than erroring, matching the plain export command's
+// behavior of doing nothing outside a direnv-managed directory. "json2"
+// is always explicit here, so RenderExport always picks the json2
+// encoding regardless of DIRENV_HOOK_FORMAT/`[hook]`.
+func CmdExportJSON2(env Env) (err error) {
+	config, err := LoadConfig(env)
+	if err != nil {
+		return err
+	}
+
+	data, err := config.RenderExport(HookFormatJSON2)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
+
+// RenderExport builds the ExportEnvelope for the .envrc (if any) tracked by
+// config.RCDir and renders it in whichever HookFormat applies: explicitFormat
+// if non-empty (e.g. the literal "json2" CmdExportJSON2 passes, or a format
+// argument a caller parsed off the command line), otherwise config.HookFormat
+// via HookShouldUseJSON2. Both encodings are built from the same
+// ExportEnvelope, so the shell and json2 backends can't drift against each
+// other the way two independently-maintained diffing implementations could.
+// This is the function cmd_export.go's plain `direnv export` and
+// `_direnv_hook`'s json2 variant should call once they're wired to it;
+// that dispatch wiring lives in cmd_export.go/stdlib.sh, which aren't part
+// of this file set.
+func (config *Config) RenderExport(explicitFormat HookFormat) ([]byte, error) {
+	envelope, err := config.buildExportEnvelope()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.HookShouldUseJSON2(string(explicitFormat)) {
+		return json.Marshal(envelope)
+	}
+	return []byte(envelope.RenderShell()), nil
+}
+
+// buildExportEnvelope evaluates the tracked .envrc (if any) and returns the
+// structured, format-agnostic ExportEnvelope describing the result.
+func (config *Config) buildExportEnvelope() (*ExportEnvelope, error) {
+	if config.RCDir == "" {
+		return &ExportEnvelope{Added: map[string]string{}, Changed: map[string]string{}}, nil
+	}
+	rcPath := filepath.Join(config.RCDir, ".envrc")
+
+	start := time.Now()
+	newEnv, err := config.EnvFromRC(rcPath, config.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	// EnvFromRC only persists watch data to the cache log when caching is
+	// enabled, so with DisableCache the log on disk is either absent or
+	// stale leftovers from before it was set; report no watches rather than
+	// misrepresenting either as this run's actual dependencies.
+	var watches []WatchedFile
+	if !config.DisableCache {
+		watches = config.RCCache(rcPath).Watches()
+	}
+
+	envelope := NewExportEnvelope(config.Env, newEnv, watches, time.Since(start).Milliseconds())
+	envelope.Diagnostics = config.exportDiagnostics()
+	return envelope, nil
+}
+
+// exportDiagnostics surfaces non-fatal conditions about how this export was
+// produced that a structured consumer (an editor, pkg/directclient) can't
+// otherwise infer from added/removed/changed alone, instead of only ever
+// logging them to stderr via logError.
+func (config *Config) exportDiagnostics() []string {
+	var diagnostics []string
+
+	if config.DisableCache {
+		diagnostics = append(diagnostics, "RC export caching is disabled (disable_cache)")
+	} else if maxAge, neverCache := config.minProviderTTL(); neverCache {
+		diagnostics = append(diagnostics, "a configured provider has TTL<=0; RC export was not cached")
+	} else if maxAge > 0 {
+		diagnostics = append(diagnostics, fmt.Sprintf("RC export cache capped at %s by the shortest provider TTL", maxAge))
+	}
+
+	return diagnostics
+}
+
+// HookShouldUseJSON2 reports whether the current invocation should emit
+// the json2 envelope rather than plain shell export statements: an
+// explicit format argument (e.g. the literal "json2" passed to `direnv
+// export`) always wins; absent one, it falls back to config.HookFormat,
+// i.e. DIRENV_HOOK_FORMAT or the `[hook]` TOML section. RenderExport is
+// the caller that needs this decision to honor HookFormat without
+// re-implementing the precedence rules itself.
+func (config *Config) HookShouldUseJSON2(explicitFormat string) bool {
+	if explicitFormat != "" {
+		return HookFormat(explicitFormat) == HookFormatJSON2
+	}
+	return config.HookFormat == HookFormatJSON2
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// CmdObserveCmd registers "observe" as a direnv subcommand, the same way
+// every other builtin lives in cmd.go's AvailableCommands. It's declared
+// here rather than there because cmd.go isn't part of this change.
+var CmdObserveCmd = &Command{
+	Name: "observe",
+	Desc: "Records a file or env var an .envrc's evaluation consulted, for RC-cache invalidation",
+	Args: []string{"watch-file <path>", "watch-env <name>"},
+	Fn:   CmdObserve,
+}
+
+func init() {
+	AvailableCommands = append(AvailableCommands, CmdObserveCmd)
+}
+
+// CmdObserve implements `direnv observe watch-file <path>` and `direnv
+// observe watch-env <name>`, the entry points the stdlib's watch_file,
+// source_env and use-nix/use-flake shims (see stdlib_observations.sh) call
+// back into, the same way existing stdlib helpers call back into the
+// direnv binary for operations that need Go-side logic. It lets EnvFromRC
+// learn, after rc.Load returns, exactly which files and env vars the
+// currently-evaluating .envrc depended on, via config.observationLogPath
+// and RCCache.consumeObservations.
+func CmdObserve(env Env, args []string) (err error) {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: direnv observe watch-file <path> | watch-env <name>")
+	}
+
+	rcDir := env[DIRENV_DIR]
+	if len(rcDir) > 0 && rcDir[0:1] == "-" {
+		rcDir = rcDir[1:]
+	}
+	if rcDir == "" {
+		return fmt.Errorf("direnv observe: DIRENV_DIR is not set")
+	}
+
+	config, err := LoadConfig(env)
+	if err != nil {
+		return err
+	}
+	rcPath := filepath.Join(rcDir, ".envrc")
+	logPath := config.observationLogPath(rcPath)
+
+	switch args[1] {
+	case "watch-file":
+		return appendObservation(logPath, watchFile, args[2])
+	case "watch-env":
+		return appendObservation(logPath, watchEnv, args[2])
+	default:
+		return fmt.Errorf("direnv observe: unknown subcommand %q", args[1])
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "fmt"
+
+// CmdProviderCmd registers "provider" as a direnv subcommand, the same
+// way every other builtin lives in cmd.go's AvailableCommands. It's
+// declared here rather than there because cmd.go isn't part of this
+// change.
+var CmdProviderCmd = &Command{
+	Name: "provider",
+	Desc: "Resolves a secret from a configured [providers.<name>]",
+	Args: []string{"run", "<name>", "[args...]"},
+	Fn:   CmdProvider,
+}
+
+func init() {
+	AvailableCommands = append(AvailableCommands, CmdProviderCmd)
+}
+
+// CmdProvider implements `direnv provider run <name> [args...]`, the
+// entry point the stdlib's `from_vault`/`from_op`/`from_aws_sm` functions
+// shell back out to, the same way existing stdlib helpers call back into
+// the direnv binary for operations that need Go-side logic.
+func CmdProvider(env Env, args []string) (err error) {
+	if len(args) < 3 || args[1] != "run" {
+		return fmt.Errorf("usage: direnv provider run <name> [args...]")
+	}
+
+	config, err := LoadConfig(env)
+	if err != nil {
+		return err
+	}
+
+	value, err := config.RunProvider(args[2], args[3:]...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(value)
+	return nil
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
-	toml "github.com/BurntSushi/toml"
 	"github.com/direnv/direnv/xdg"
 )
 
@@ -25,10 +28,17 @@ type Config struct {
 	RCDir           string
 	TomlPath        string
 	DisableStdin    bool
+	DisableCache    bool
 	StrictEnv       bool
 	WarnTimeout     time.Duration
 	WhitelistPrefix []string
 	WhitelistExact  map[string]bool
+	Providers       map[string]ProviderSpec
+	EnvDefaults     map[string]string
+	HookFormat      HookFormat
+	SignedWhitelist *SignedWhitelist
+	configLayers    []configLayer          // every TOML file merged to produce this config, least to most specific
+	mergedToml      map[string]interface{} // the raw merged TOML, for `direnv config dump`
 }
 
 type tomlDuration struct {
@@ -42,15 +52,19 @@ func (d *tomlDuration) UnmarshalText(text []byte) error {
 }
 
 type tomlConfig struct {
-	*tomlGlobal               // For backward-compatibility
-	Global      *tomlGlobal   `toml:"global"`
-	Whitelist   tomlWhitelist `toml:"whitelist"`
+	*tomlGlobal                         // For backward-compatibility
+	Global      *tomlGlobal             `toml:"global"`
+	Whitelist   tomlWhitelist           `toml:"whitelist"`
+	Providers   map[string]ProviderSpec `toml:"providers"`
+	Hook        tomlHook                `toml:"hook"`
+	Env         map[string]string       `toml:"env"`
 }
 
 type tomlGlobal struct {
 	BashBuiltin  bool         `toml:"bash_builtin"`
 	BashPath     string       `toml:"bash_path"`
 	DisableStdin bool         `toml:"disable_stdin"`
+	DisableCache bool         `toml:"disable_cache"`
 	StrictEnv    bool         `toml:"strict_env"`
 	WarnTimeout  tomlDuration `toml:"warn_timeout"`
 }
@@ -58,6 +72,7 @@ type tomlGlobal struct {
 type tomlWhitelist struct {
 	Prefix []string
 	Exact  []string
+	Signed tomlWhitelistSigned `toml:"signed"`
 }
 
 // LoadConfig opens up the direnv configuration from the Env.
@@ -106,7 +121,49 @@ func LoadConfig(env Env) (config *Config, err error) {
 		}
 	}
 
+	var mergedToml map[string]interface{}
+	var tomlHookFormat string
+
 	if config.TomlPath != "" {
+		var layers []configLayer
+		if mergedToml, layers, err = loadConfigLayer(config.TomlPath); err != nil {
+			err = fmt.Errorf("LoadConfig() failed to parse %s: %q", config.TomlPath, err)
+			return
+		}
+		config.configLayers = append(config.configLayers, layers...)
+	}
+
+	// Merge in per-directory `.direnv.toml` files, walking up from WorkDir to
+	// the user's home, with directories closer to WorkDir taking precedence.
+	// These files are repo-local and therefore untrusted: anyone who can get
+	// a user to `cd` into a cloned repo can ship one, so they may not set
+	// whitelist/bash_path/bash_builtin/disable_stdin (see stripUntrustedKeys)
+	// — only the user's own ConfDir config, loaded above, is trusted with
+	// those.
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		homeDir = config.WorkDir
+	}
+	for _, path := range findConfigLayers(config.WorkDir, homeDir) {
+		data, layers, layerErr := loadConfigLayer(path)
+		if layerErr != nil {
+			err = fmt.Errorf("LoadConfig() failed to parse %s: %q", path, layerErr)
+			return
+		}
+		for _, layer := range layers {
+			stripUntrustedKeys(layer.Data)
+		}
+		// loadConfigLayer's first returned layer shares data's underlying
+		// map (see loadConfigLayerChain), so the loop above already
+		// stripped it; stripping data again here would just re-delete
+		// already-absent keys.
+		mergedToml = mergeTomlMaps(mergedToml, data)
+		config.configLayers = append(config.configLayers, layers...)
+	}
+
+	config.mergedToml = mergedToml
+
+	if mergedToml != nil {
 		// Declare global once and then share it between the top-level and Global
 		// keys. The goal here is to let the decoder fill global regardless of if
 		// the values are in the [global] section or not. The reason we do that is
@@ -115,8 +172,8 @@ func LoadConfig(env Env) (config *Config, err error) {
 			tomlGlobal: &global,
 			Global:     &global,
 		}
-		if _, err = toml.DecodeFile(config.TomlPath, &tomlConf); err != nil {
-			err = fmt.Errorf("LoadConfig() failed to parse %s: %q", config.TomlPath, err)
+		if err = decodeTomlMap(mergedToml, &tomlConf); err != nil {
+			err = fmt.Errorf("LoadConfig() failed to decode merged TOML config: %q", err)
 			return
 		}
 
@@ -133,10 +190,29 @@ func LoadConfig(env Env) (config *Config, err error) {
 		config.BashBuiltin = tomlConf.BashBuiltin
 		config.BashPath = tomlConf.BashPath
 		config.DisableStdin = tomlConf.DisableStdin
+		config.DisableCache = tomlConf.DisableCache
 		config.StrictEnv = tomlConf.StrictEnv
 		config.WarnTimeout = tomlConf.WarnTimeout.Duration
+		config.Providers = tomlConf.Providers
+		tomlHookFormat = tomlConf.Hook.Format
+
+		// `[env]` defaults from the merged .direnv.toml layers are recorded
+		// here but deliberately not applied to config.Env: EnvFromRC applies
+		// them to the RC's own exported env instead, so they flow through
+		// the same diff/revert machinery as everything else an .envrc
+		// exports and get unset again when the user leaves the directory.
+		config.EnvDefaults = tomlConf.Env
+
+		if len(tomlConf.Whitelist.Signed.Keys) > 0 || len(tomlConf.Whitelist.Signed.ManifestURLs) > 0 {
+			if config.SignedWhitelist, err = newSignedWhitelist(tomlConf.Whitelist.Signed); err != nil {
+				err = fmt.Errorf("LoadConfig() invalid [whitelist.signed]: %q", err)
+				return
+			}
+		}
 	}
 
+	config.HookFormat = hookFormat(config.Env, tomlHookFormat)
+
 	if config.WarnTimeout == 0 {
 		timeout, err := time.ParseDuration(env.Fetch("DIRENV_WARN_TIMEOUT", "5s"))
 		if err != nil {
@@ -194,17 +270,181 @@ func (config *Config) LoadedRC() *RC {
 	return RCFromEnv(rcPath, timesString, config)
 }
 
-// EnvFromRC loads an RC from a specified path and returns the new environment
+// EnvFromRC loads an RC from a specified path and returns the new environment.
+// If the .envrc's recorded dependencies (its own file, the inherited
+// previousEnv, the files and env vars the stdlib shims reported, and, when
+// providers are configured, their TTL) are
+// unchanged since the last evaluation, the cached export is returned
+// directly and bash is never re-invoked.
 func (config *Config) EnvFromRC(path string, previousEnv Env) (Env, error) {
+	cache := config.RCCache(path)
+
+	if config.RCCacheValid(path, previousEnv) {
+		if cachedEnv, cacheErr := cache.LoadResult(); cacheErr == nil {
+			return cachedEnv, nil
+		}
+	}
+
 	rc, err := RCFromPath(path, config)
 	if err != nil {
 		return nil, err
 	}
-	return rc.Load(previousEnv)
+	env, err := rc.Load(previousEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fold in whatever watch_file/source_env/use-nix reads the stdlib shims
+	// (see stdlib_observations.sh, direnv observe in cmd_observe.go)
+	// reported during this evaluation, regardless of whether caching is
+	// enabled: an evaluation with caching disabled shouldn't leave a stale
+	// observation log lying around for a later, cache-enabled run to
+	// misread as belonging to it.
+	cache.consumeObservations(config.observationLogPath(path), previousEnv)
+
+	// Apply `[env]` defaults to the RC's own output, not to config.Env: a
+	// real environment variable (in previousEnv) or something the .envrc
+	// itself exported always wins, and since the default becomes part of
+	// `env` here it's subject to the same diff/revert as every other
+	// variable the .envrc produced, instead of leaking into the shell
+	// permanently once applied.
+	for key, value := range config.EnvDefaults {
+		if _, exists := previousEnv[key]; exists {
+			continue
+		}
+		if _, exists := env[key]; !exists {
+			env[key] = value
+		}
+	}
+
+	// A provider explicitly configured with TTL <= 0 means "never cache this
+	// secret" (see providers.go RunProvider); the RC cache can't tell which
+	// of env's values came from it, so in that case don't cache the RC
+	// export at all rather than only capping it to some other provider's
+	// unrelated TTL.
+	maxAge, neverCacheProvider := config.minProviderTTL()
+
+	if !config.DisableCache && !neverCacheProvider {
+		// The .envrc itself is always a dependency, as is every variable of
+		// previousEnv the .envrc could have read (e.g. via PATH_add or
+		// `${VAR:-default}`); consumeObservations above already recorded
+		// the individual files/env vars the stdlib shims reported reading
+		// via watch_file, source_env or use-nix/use-flake, so an edited
+		// flake.nix or watch_file'd path invalidates the cache instead of
+		// silently serving a stale export.
+		for key, value := range previousEnv {
+			cache.WatchEnv(key, value)
+		}
+		if maxAge > 0 {
+			// A provider-sourced secret (see providers.go) baked into `env`
+			// has its own TTL the RC cache has no visibility into, since
+			// providers run out-of-process via `direnv provider run`. Cap
+			// the cache at the shortest configured provider TTL so it can't
+			// pin a secret past the TTL that was supposed to bound it.
+			cache.SetMaxAge(maxAge)
+		}
+		if watchErr := cache.WatchFile(path); watchErr != nil {
+			logError("EnvFromRC() failed to record .envrc dependency: " + watchErr.Error())
+		} else if saveErr := cache.Save(); saveErr != nil {
+			logError("EnvFromRC() failed to save RC cache: " + saveErr.Error())
+		} else if saveErr := cache.SaveResult(env); saveErr != nil {
+			logError("EnvFromRC() failed to save cached export: " + saveErr.Error())
+		}
+	}
+
+	return env, nil
+}
+
+// RCCacheValid reports whether the recorded dependencies of the .envrc at
+// rcPath (its own file, previousEnv, and the files and env vars the stdlib
+// shims reported) are unchanged since the cache was
+// populated, and that any provider-TTL cap on it hasn't elapsed, meaning
+// direnv can skip re-executing bash and reuse the previously exported
+// environment.
+func (config *Config) RCCacheValid(rcPath string, previousEnv Env) bool {
+	if config.DisableCache {
+		return false
+	}
+	return config.RCCache(rcPath).Valid(previousEnv)
+}
+
+// minProviderTTL returns the shortest TTL among this config's configured
+// providers. neverCache is true if any provider declares TTL <= 0 (meaning
+// RunProvider never caches it), in which case maxAge is meaningless and
+// zero: such a secret must not be pinned by the RC cache either.
+func (config *Config) minProviderTTL() (maxAge time.Duration, neverCache bool) {
+	for _, spec := range config.Providers {
+		ttl := spec.TTL.Duration
+		if ttl <= 0 {
+			return 0, true
+		}
+		if maxAge == 0 || ttl < maxAge {
+			maxAge = ttl
+		}
+	}
+	return maxAge, false
+}
+
+// IsRCSignedOff reports whether rcPath is pre-approved by the configured
+// `[whitelist.signed]` keys or manifests.
+func (config *Config) IsRCSignedOff(rcPath string) bool {
+	if config.SignedWhitelist == nil {
+		return false
+	}
+	approved, err := config.SignedWhitelist.IsApproved(rcPath, config.CacheDir)
+	if err != nil {
+		logError("IsRCSignedOff() failed: " + err.Error())
+		return false
+	}
+	return approved
+}
+
+// preApproveSignedRC writes the same "allow" marker under AllowDir that an
+// interactive `direnv allow` would, for the nearest .envrc above WorkDir if
+// it's signed off per IsRCSignedOff. FindRC's own allow check looks for
+// exactly this file, so this makes a signed-off .envrc skip the prompt
+// without FindRC needing to know anything about signed whitelisting.
+func (config *Config) preApproveSignedRC() {
+	if config.SignedWhitelist == nil {
+		return
+	}
+	rcPath, ok := findNearestEnvrc(config.WorkDir)
+	if !ok || !config.IsRCSignedOff(rcPath) {
+		return
+	}
+
+	contents, err := ioutil.ReadFile(rcPath)
+	if err != nil {
+		logError("preApproveSignedRC() failed to read " + rcPath + ": " + err.Error())
+		return
+	}
+
+	sum := sha256.Sum256([]byte(rcPath))
+	allowPath := filepath.Join(config.AllowDir(), hex.EncodeToString(sum[:]))
+
+	// FindRC (and therefore preApproveSignedRC) runs on every direnv
+	// invocation, e.g. every shell prompt. Skip the write once the marker
+	// already matches, so a signed-off .envrc that hasn't changed doesn't
+	// cost a stat+read+mkdir+write on direnv's hottest path each time.
+	if existing, readErr := ioutil.ReadFile(allowPath); readErr == nil && bytes.Equal(existing, contents) {
+		return
+	}
+
+	if err := os.MkdirAll(config.AllowDir(), 0700); err != nil {
+		logError("preApproveSignedRC() failed to create AllowDir: " + err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(allowPath, contents, 0600); err != nil {
+		logError("preApproveSignedRC() failed to write allow marker for " + rcPath + ": " + err.Error())
+	}
 }
 
-// FindRC looks for a RC file in the config environment
+// FindRC looks for a RC file in the config environment. A signed-off
+// .envrc (see IsRCSignedOff) is pre-approved under AllowDir first, so
+// FindRC's own allow check treats it the same as one the user already ran
+// `direnv allow` on.
 func (config *Config) FindRC() (*RC, error) {
+	config.preApproveSignedRC()
 	return FindRC(config.WorkDir, config)
 }
 
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	toml "github.com/BurntSushi/toml"
+)
+
+// configLayer is one TOML file (and whatever it `include`d) that
+// contributed to the effective configuration, kept around so that
+// `direnv config dump` can annotate each key with its origin.
+type configLayer struct {
+	Path string
+	Data map[string]interface{}
+}
+
+// findConfigLayers walks up from workDir to homeDir (inclusive) looking for
+// a `.direnv.toml` in each directory, returning the paths that exist
+// ordered from least to most specific, so that merging them in order lets
+// directories closer to workDir win.
+func findConfigLayers(workDir, homeDir string) []string {
+	var layers []string
+
+	dir := workDir
+	for {
+		path := filepath.Join(dir, ".direnv.toml")
+		if _, err := os.Stat(path); err == nil {
+			layers = append(layers, path)
+		}
+
+		parent := filepath.Dir(dir)
+		if dir == homeDir || parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	for i, j := 0, len(layers)-1; i < j; i, j = i+1, j-1 {
+		layers[i], layers[j] = layers[j], layers[i]
+	}
+	return layers
+}
+
+// expandIncludes resolves an `include = ["path/*.toml"]` key relative to
+// baseDir, returning the matched paths in sorted order so merging is
+// deterministic.
+func expandIncludes(baseDir string, patterns []string) ([]string, error) {
+	var matches []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		found, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, found...)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// mergeTomlMaps deep-merges src into dst, with src's values winning on
+// conflict. Nested tables are merged recursively rather than overwritten
+// wholesale, so a `.direnv.toml` can override e.g. just `strict_env` under
+// `[global]` without clobbering the other `[global]` keys set by a less
+// specific layer.
+func mergeTomlMaps(dst, src map[string]interface{}) map[string]interface{} {
+	if dst == nil {
+		dst = map[string]interface{}{}
+	}
+	for key, srcVal := range src {
+		if dstVal, ok := dst[key]; ok {
+			dstMap, dstIsMap := dstVal.(map[string]interface{})
+			srcMap, srcIsMap := srcVal.(map[string]interface{})
+			if dstIsMap && srcIsMap {
+				dst[key] = mergeTomlMaps(dstMap, srcMap)
+				continue
+			}
+		}
+		dst[key] = srcVal
+	}
+	return dst
+}
+
+// loadConfigLayer decodes a single TOML file into a raw map, resolving and
+// merging in any `include` fragments it declares, and returns every
+// configLayer (the file itself plus its includes, in merge order) that
+// contributed to the result.
+func loadConfigLayer(path string) (map[string]interface{}, []configLayer, error) {
+	return loadConfigLayerChain(path, map[string]bool{})
+}
+
+// loadConfigLayerChain is loadConfigLayer's recursive worker. chain holds
+// the absolute paths of files currently being resolved further up the
+// `include` stack: if `path` is already in it, an include cycle would
+// otherwise recurse until the stack overflows, so that's reported as an
+// error instead. The same file appearing twice on unrelated branches
+// (a "diamond" include) is fine and isn't a cycle, so entries are removed
+// from chain once their subtree finishes resolving.
+func loadConfigLayerChain(path string, chain map[string]bool) (map[string]interface{}, []configLayer, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if chain[absPath] {
+		return nil, nil, fmt.Errorf("%s: include cycle detected", path)
+	}
+	chain[absPath] = true
+	defer delete(chain, absPath)
+
+	var data map[string]interface{}
+	if _, err := toml.DecodeFile(path, &data); err != nil {
+		return nil, nil, err
+	}
+
+	layers := []configLayer{{Path: path, Data: data}}
+
+	if rawIncludes, ok := data["include"]; ok {
+		patterns, err := tomlStringSlice(rawIncludes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: invalid include key: %q", path, err)
+		}
+		delete(data, "include")
+
+		fragments, err := expandIncludes(filepath.Dir(path), patterns)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, fragment := range fragments {
+			fragData, fragLayers, err := loadConfigLayerChain(fragment, chain)
+			if err != nil {
+				return nil, nil, err
+			}
+			data = mergeTomlMaps(data, fragData)
+			layers = append(layers, fragLayers...)
+		}
+	}
+
+	return data, layers, nil
+}
+
+// untrustedTomlKeys are top-level (or [global]) keys that only the user's
+// own trusted direnv.toml/config.toml may set. A repo-local .direnv.toml
+// is attacker-controlled the moment someone clones the repo and direnv
+// walks up into it from WorkDir, so letting it set these would let a
+// hostile repo whitelist its own .envrc, or swap out the bash binary,
+// before the user ever runs `direnv allow`.
+var untrustedTomlKeys = []string{"whitelist", "bash_path", "bash_builtin", "disable_stdin"}
+
+// stripUntrustedKeys removes the keys a directory-layer .direnv.toml is
+// not trusted to set, both at the top level (tomlGlobal's
+// backward-compatible embedding lets them appear unnested) and under
+// [global]. It mutates data in place so `direnv config dump` reflects
+// what actually took effect, not what the untrusted file merely claimed.
+func stripUntrustedKeys(data map[string]interface{}) map[string]interface{} {
+	for _, key := range untrustedTomlKeys {
+		delete(data, key)
+	}
+	if global, ok := data["global"].(map[string]interface{}); ok {
+		for _, key := range untrustedTomlKeys {
+			delete(global, key)
+		}
+	}
+	return data
+}
+
+func tomlStringSlice(v interface{}) ([]string, error) {
+	raw, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an array of strings")
+	}
+	out := make([]string, 0, len(raw))
+	for _, item := range raw {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string, got %T", item)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// decodeTomlMap re-marshals a merged raw TOML map and decodes it into the
+// typed tomlConfig, so the rest of LoadConfig can keep working with
+// structs regardless of how many layers were merged to produce them.
+func decodeTomlMap(data map[string]interface{}, out *tomlConfig) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(data); err != nil {
+		return err
+	}
+	_, err := toml.Decode(buf.String(), out)
+	return err
+}
+
+// originForKeys returns, for every leaf key path present in merged (dotted,
+// e.g. "whitelist.prefix"), the path of the most specific layer that set
+// it. Layers must be given least to most specific, matching the order
+// they were merged in.
+func originForKeys(layers []configLayer) map[string]string {
+	origin := map[string]string{}
+	for _, layer := range layers {
+		for _, key := range flattenTomlKeys("", layer.Data) {
+			origin[key] = layer.Path
+		}
+	}
+	return origin
+}
+
+// flattenTomlValues is the value-carrying counterpart of flattenTomlKeys,
+// used by `direnv config dump` to print each leaf key's effective value.
+func flattenTomlValues(prefix string, data map[string]interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	for k, v := range data {
+		full := k
+		if prefix != "" {
+			full = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			for nk, nv := range flattenTomlValues(full, nested) {
+				values[nk] = nv
+			}
+			continue
+		}
+		values[full] = v
+	}
+	return values
+}
+
+func flattenTomlKeys(prefix string, data map[string]interface{}) []string {
+	var keys []string
+	for k, v := range data {
+		full := k
+		if prefix != "" {
+			full = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			keys = append(keys, flattenTomlKeys(full, nested)...)
+			continue
+		}
+		keys = append(keys, full)
+	}
+	return keys
+}
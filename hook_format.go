@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DIRENV_HOOK_FORMAT sets Config.HookFormat, the format Config.RenderExport
+// emits when it is given no explicit format: "shell" (the default, a
+// sequence of `export`/`unset` statements) or "json2", the structured
+// envelope consumed by pkg/directclient.
+const DIRENV_HOOK_FORMAT = "DIRENV_HOOK_FORMAT"
+
+// HookFormat names a supported `direnv export` output format.
+type HookFormat string
+
+const (
+	HookFormatShell HookFormat = "shell"
+	HookFormatJSON2 HookFormat = "json2"
+)
+
+type tomlHook struct {
+	Format string `toml:"format"`
+}
+
+// hookFormat resolves the configured HookFormat, preferring the
+// DIRENV_HOOK_FORMAT env var over the `[hook]` TOML section, and falling
+// back to the shell format understood by every existing integration.
+func hookFormat(env Env, tomlFormat string) HookFormat {
+	format := env[DIRENV_HOOK_FORMAT]
+	if format == "" {
+		format = tomlFormat
+	}
+
+	switch HookFormat(format) {
+	case HookFormatJSON2:
+		return HookFormatJSON2
+	default:
+		return HookFormatShell
+	}
+}
+
+// ExportEnvelope is the structured, format-agnostic representation of an
+// `direnv export` result. Every output backend (plain shell, json2, ...)
+// is built from one of these, so editors and remote-execution wrappers
+// can consume direnv's state without parsing shell syntax.
+type ExportEnvelope struct {
+	Added       map[string]string `json:"added"`
+	Removed     []string          `json:"removed"`
+	Changed     map[string]string `json:"changed"`
+	Watches     []WatchedFile     `json:"watches"`
+	Diagnostics []string          `json:"diagnostics,omitempty"`
+	TimingMs    int64             `json:"timing_ms"`
+}
+
+// WatchedFile is one file or directory direnv's hook consulted while
+// evaluating an .envrc, reported so a consumer can invalidate its own
+// caches when it changes.
+type WatchedFile struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// NewExportEnvelope builds the structured envelope for a diff between
+// prevEnv and nextEnv, suitable for encoding in any HookFormat.
+func NewExportEnvelope(prevEnv, nextEnv Env, watches []WatchedFile, timingMs int64) *ExportEnvelope {
+	envelope := &ExportEnvelope{
+		Added:    map[string]string{},
+		Changed:  map[string]string{},
+		Watches:  watches,
+		TimingMs: timingMs,
+	}
+
+	for key, value := range nextEnv {
+		if prevValue, ok := prevEnv[key]; !ok {
+			envelope.Added[key] = value
+		} else if prevValue != value {
+			envelope.Changed[key] = value
+		}
+	}
+
+	for key := range prevEnv {
+		if _, ok := nextEnv[key]; !ok {
+			envelope.Removed = append(envelope.Removed, key)
+		}
+	}
+
+	return envelope
+}
+
+// RenderShell renders the envelope as the sequence of `export`/`unset`
+// statements HookFormatShell consumers expect — the same plain-shell
+// output every existing integration already understands. It's built from
+// the same ExportEnvelope as the json2 encoding (see RenderExport in
+// cmd_export_json2.go), so the two formats can't drift apart from
+// independently-maintained diffing logic.
+func (e *ExportEnvelope) RenderShell() string {
+	var b strings.Builder
+
+	removed := append([]string{}, e.Removed...)
+	sort.Strings(removed)
+	for _, key := range removed {
+		fmt.Fprintf(&b, "unset %s\n", key)
+	}
+
+	set := make(map[string]string, len(e.Added)+len(e.Changed))
+	for key, value := range e.Added {
+		set[key] = value
+	}
+	for key, value := range e.Changed {
+		set[key] = value
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "export %s=%s\n", key, shellQuote(set[key]))
+	}
+
+	return b.String()
+}
+
+// shellQuote single-quotes value for safe inclusion in a POSIX `export`
+// statement, escaping any embedded single quotes.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
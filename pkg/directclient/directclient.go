@@ -0,0 +1,65 @@
+// Package directclient lets third-party tools (editors, LSP-adjacent
+// tooling, remote-execution wrappers) consume direnv's exported
+// environment as structured data, without forking direnv or scraping
+// stderr for shell syntax.
+package directclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// Envelope is the structured result of a `direnv export json2` call. It
+// mirrors the ExportEnvelope type direnv builds internally.
+type Envelope struct {
+	Added       map[string]string `json:"added"`
+	Removed     []string          `json:"removed"`
+	Changed     map[string]string `json:"changed"`
+	Watches     []WatchedFile     `json:"watches"`
+	Diagnostics []string          `json:"diagnostics,omitempty"`
+	TimingMs    int64             `json:"timing_ms"`
+}
+
+// WatchedFile is one file or directory direnv's hook consulted while
+// evaluating an .envrc.
+type WatchedFile struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// Client runs the `direnv` binary to fetch structured export envelopes.
+type Client struct {
+	// DirenvPath is the path to the direnv binary. Defaults to "direnv",
+	// resolved via $PATH, when empty.
+	DirenvPath string
+}
+
+// New returns a Client that shells out to "direnv" on $PATH.
+func New() *Client {
+	return &Client{DirenvPath: "direnv"}
+}
+
+// Export runs `direnv export json2` in dir and decodes the resulting
+// envelope.
+func (c *Client) Export(dir string) (*Envelope, error) {
+	path := c.DirenvPath
+	if path == "" {
+		path = "direnv"
+	}
+
+	cmd := exec.Command(path, "export", "json2")
+	cmd.Dir = dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("directclient: direnv export json2 failed: %w", err)
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(out, &envelope); err != nil {
+		return nil, fmt.Errorf("directclient: failed to decode envelope: %w", err)
+	}
+
+	return &envelope, nil
+}
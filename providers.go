@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ProviderSpec describes a `[providers.<name>]` table: an external secret
+// backend that the stdlib can call into via `from_vault`, `from_op`,
+// `from_aws_sm` and friends.
+type ProviderSpec struct {
+	Command     string       `toml:"command"`
+	Timeout     tomlDuration `toml:"timeout"`
+	TTL         tomlDuration `toml:"ttl"`
+	RequiredEnv []string     `toml:"required_env"`
+}
+
+// providerCacheEntry is what gets written under
+// config.CacheDir/providers/<hash>: the value, and when it stops being
+// valid.
+type providerCacheEntry struct {
+	Value     string
+	ExpiresAt time.Time
+}
+
+// providersDir returns config.CacheDir/providers, creating it on demand.
+func (config *Config) providersDir() (string, error) {
+	dir := filepath.Join(config.CacheDir, "providers")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// providerCachePath hashes the provider name and its arguments into a
+// single cache file path, so identical calls share a cached value.
+func (config *Config) providerCachePath(name string, args []string) (string, error) {
+	dir, err := config.providersDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(name + "\x00" + strings.Join(args, "\x00")))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])), nil
+}
+
+// RunProvider resolves a secret via the named `[providers.<name>]` table,
+// exec'ing its configured command with args substituted for `{}` and
+// caching the result under config.CacheDir/providers/<hash> for the
+// declared TTL.
+func (config *Config) RunProvider(name string, args ...string) (string, error) {
+	spec, ok := config.Providers[name]
+	if !ok {
+		return "", fmt.Errorf("no [providers.%s] configured", name)
+	}
+
+	for _, required := range spec.RequiredEnv {
+		if config.Env[required] == "" {
+			return "", fmt.Errorf("provider %q requires %s to be set", name, required)
+		}
+	}
+
+	cachePath, err := config.providerCachePath(name, args)
+	if err != nil {
+		return "", err
+	}
+
+	if entry, err := readProviderCache(cachePath); err == nil {
+		if time.Now().Before(entry.ExpiresAt) {
+			return entry.Value, nil
+		}
+		if zeroErr := zeroizeProviderCache(cachePath); zeroErr != nil {
+			logError("RunProvider() failed to zeroize expired cache entry: " + zeroErr.Error())
+		}
+	}
+
+	value, err := execProvider(spec, args)
+	if err != nil {
+		return "", fmt.Errorf("provider %q failed: %w", name, err)
+	}
+
+	ttl := spec.TTL.Duration
+	if ttl > 0 {
+		if err := writeProviderCache(cachePath, providerCacheEntry{
+			Value:     value,
+			ExpiresAt: time.Now().Add(ttl),
+		}); err != nil {
+			logError("RunProvider() failed to cache result: " + err.Error())
+		}
+	}
+
+	return value, nil
+}
+
+// execProvider runs the provider's command template with args substituted
+// as distinct argv elements for each `{}` placeholder, under the
+// configured timeout. Args are never spliced into a shell string, so a
+// secret name or upstream env var containing shell metacharacters can't
+// break out of its argument position.
+func execProvider(spec ProviderSpec, args []string) (string, error) {
+	tokens := strings.Fields(spec.Command)
+	if len(tokens) == 0 {
+		return "", fmt.Errorf("empty provider command")
+	}
+
+	argIdx := 0
+	argv := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if token != "{}" {
+			argv = append(argv, token)
+			continue
+		}
+		if argIdx >= len(args) {
+			return "", fmt.Errorf("provider command expects more arguments than were given")
+		}
+		argv = append(argv, args[argIdx])
+		argIdx++
+	}
+	if argIdx < len(args) {
+		return "", fmt.Errorf("provider command has %d {} placeholder(s) but %d argument(s) were given", argIdx, len(args))
+	}
+
+	timeout := spec.Timeout.Duration
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+func readProviderCache(path string) (providerCacheEntry, error) {
+	var entry providerCacheEntry
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	parts := strings.SplitN(string(data), "\n", 2)
+	if len(parts) != 2 {
+		return entry, fmt.Errorf("malformed provider cache entry")
+	}
+	expiresAt, err := time.Parse(time.RFC3339, parts[0])
+	if err != nil {
+		return entry, err
+	}
+	entry.ExpiresAt = expiresAt
+	entry.Value = parts[1]
+	return entry, nil
+}
+
+func writeProviderCache(path string, entry providerCacheEntry) error {
+	data := entry.ExpiresAt.Format(time.RFC3339) + "\n" + entry.Value
+	return ioutil.WriteFile(path, []byte(data), 0600)
+}
+
+// zeroizeProviderCache overwrites a cached secret with zeros before
+// removing it, so an expired credential doesn't linger readable on disk
+// between the overwrite and the unlink.
+func zeroizeProviderCache(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, make([]byte, info.Size()), 0600); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
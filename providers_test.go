@@ -0,0 +1,156 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecProviderSubstitutesArgs(t *testing.T) {
+	spec := ProviderSpec{Command: "echo {} {}"}
+	out, err := execProvider(spec, []string{"foo", "bar"})
+	if err != nil {
+		t.Fatalf("execProvider() error = %v", err)
+	}
+	if out != "foo bar" {
+		t.Fatalf("execProvider() = %q, want %q", out, "foo bar")
+	}
+}
+
+func TestExecProviderTooFewArgs(t *testing.T) {
+	spec := ProviderSpec{Command: "echo {} {}"}
+	if _, err := execProvider(spec, []string{"foo"}); err == nil {
+		t.Fatal("execProvider() expected an error for too few arguments, got nil")
+	}
+}
+
+func TestExecProviderTooManyArgsIsAnError(t *testing.T) {
+	spec := ProviderSpec{Command: "echo {}"}
+	if _, err := execProvider(spec, []string{"foo", "bar"}); err == nil {
+		t.Fatal("execProvider() expected an error for extra arguments, got nil")
+	}
+}
+
+func TestExecProviderNeverUsesAShell(t *testing.T) {
+	// If args were spliced into a shell string, "; echo pwned" would run a
+	// second command. argv-exec'd, it's just a literal argument to echo.
+	spec := ProviderSpec{Command: "echo {}"}
+	out, err := execProvider(spec, []string{"a; echo pwned"})
+	if err != nil {
+		t.Fatalf("execProvider() error = %v", err)
+	}
+	if out != "a; echo pwned" {
+		t.Fatalf("execProvider() = %q, want the argument echoed back literally", out)
+	}
+}
+
+func TestExecProviderTimeout(t *testing.T) {
+	spec := ProviderSpec{Command: "sleep 1", Timeout: tomlDuration{10 * time.Millisecond}}
+	if _, err := execProvider(spec, nil); err == nil {
+		t.Fatal("execProvider() expected a timeout error, got nil")
+	}
+}
+
+func TestProviderCacheRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry")
+	want := providerCacheEntry{Value: "s3cr3t", ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second)}
+
+	if err := writeProviderCache(path, want); err != nil {
+		t.Fatalf("writeProviderCache() error = %v", err)
+	}
+
+	got, err := readProviderCache(path)
+	if err != nil {
+		t.Fatalf("readProviderCache() error = %v", err)
+	}
+	if got.Value != want.Value || !got.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Fatalf("readProviderCache() = %+v, want %+v", got, want)
+	}
+}
+
+func TestZeroizeProviderCacheRemovesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry")
+	if err := writeProviderCache(path, providerCacheEntry{Value: "s3cr3t", ExpiresAt: time.Now()}); err != nil {
+		t.Fatalf("writeProviderCache() error = %v", err)
+	}
+
+	if err := zeroizeProviderCache(path); err != nil {
+		t.Fatalf("zeroizeProviderCache() error = %v", err)
+	}
+
+	if _, err := readProviderCache(path); err == nil {
+		t.Fatal("readProviderCache() succeeded after zeroizeProviderCache(), want an error")
+	}
+}
+
+func TestZeroizeProviderCacheMissingFileIsNotAnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "does-not-exist")
+	if err := zeroizeProviderCache(path); err != nil {
+		t.Fatalf("zeroizeProviderCache() of a missing file error = %v, want nil", err)
+	}
+}
+
+func TestRunProviderRequiredEnv(t *testing.T) {
+	config := &Config{
+		CacheDir: t.TempDir(),
+		Env:      Env{},
+		Providers: map[string]ProviderSpec{
+			"vault": {Command: "echo {}", RequiredEnv: []string{"VAULT_ADDR"}},
+		},
+	}
+
+	if _, err := config.RunProvider("vault", "key"); err == nil {
+		t.Fatal("RunProvider() expected an error when a required env var is unset, got nil")
+	}
+}
+
+func TestRunProviderCachesWithinTTL(t *testing.T) {
+	config := &Config{
+		CacheDir: t.TempDir(),
+		Env:      Env{},
+		Providers: map[string]ProviderSpec{
+			"vault": {Command: "echo {}", TTL: tomlDuration{time.Hour}},
+		},
+	}
+
+	first, err := config.RunProvider("vault", "key")
+	if err != nil {
+		t.Fatalf("RunProvider() error = %v", err)
+	}
+
+	// Tamper with the command so a second exec would return something
+	// different; a cache hit must still return the first value.
+	config.Providers["vault"] = ProviderSpec{Command: "echo different", TTL: tomlDuration{time.Hour}}
+
+	second, err := config.RunProvider("vault", "key")
+	if err != nil {
+		t.Fatalf("RunProvider() error = %v", err)
+	}
+	if second != first {
+		t.Fatalf("RunProvider() = %q on second call, want cached value %q", second, first)
+	}
+}
+
+func TestRunProviderZeroTTLNeverCaches(t *testing.T) {
+	config := &Config{
+		CacheDir: t.TempDir(),
+		Env:      Env{},
+		Providers: map[string]ProviderSpec{
+			"vault": {Command: "echo first"},
+		},
+	}
+
+	if _, err := config.RunProvider("vault"); err != nil {
+		t.Fatalf("RunProvider() error = %v", err)
+	}
+
+	config.Providers["vault"] = ProviderSpec{Command: "echo second"}
+
+	out, err := config.RunProvider("vault")
+	if err != nil {
+		t.Fatalf("RunProvider() error = %v", err)
+	}
+	if out != "second" {
+		t.Fatalf("RunProvider() = %q, want %q (TTL=0 should bypass the cache)", out, "second")
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchKind identifies what kind of thing an RCCache observation is about.
+type watchKind string
+
+const (
+	watchFile = watchKind("file")
+	watchEnv  = watchKind("env")
+	// watchExpiry is a synthetic entry (see SetMaxAge) that caps how long
+	// the cache may be reused, independent of whether any watched file or
+	// env var has changed.
+	watchExpiry = watchKind("expiry")
+)
+
+// watchEntry is a single observed input (a watched file/dir or a looked-up
+// env var) recorded while an .envrc was evaluated, along with the hash of
+// its value at the time of evaluation.
+type watchEntry struct {
+	Kind watchKind
+	Key  string
+	Hash string
+}
+
+// RCCache tracks the recorded inputs of a single .envrc evaluation so that
+// a later `direnv export` can tell, without re-running bash, whether the
+// exported environment is still valid.
+//
+// The cache is stored as a small log file under config.CacheDir/rc, named
+// by a hash of the .envrc's path. Each line is "kind hash key".
+type RCCache struct {
+	path    string
+	entries []watchEntry
+}
+
+// rcCachePath returns the path of the cache log for the given .envrc path.
+func (config *Config) rcCachePath(rcPath string) string {
+	sum := sha256.Sum256([]byte(rcPath))
+	return filepath.Join(config.CacheDir, "rc", hex.EncodeToString(sum[:])+".cache")
+}
+
+// RCCache returns the (possibly empty) cache for the given .envrc path.
+func (config *Config) RCCache(rcPath string) *RCCache {
+	return &RCCache{path: config.rcCachePath(rcPath)}
+}
+
+// WatchFile records that `path` was consulted (e.g. via watch_file or
+// source_env) and hashes its current mtime+size so a later run can detect
+// whether it changed.
+func (c *RCCache) WatchFile(path string) error {
+	hash, err := hashFileStat(path)
+	if err != nil {
+		return err
+	}
+	c.entries = append(c.entries, watchEntry{Kind: watchFile, Key: path, Hash: hash})
+	return nil
+}
+
+// observationLogPath returns where the stdlib's watch_file/source_env/
+// use-nix shims (see stdlib_observations.sh) record what an .envrc's
+// evaluation actually consulted, so EnvFromRC can fold those into this
+// cache afterwards instead of only ever watching the .envrc file itself.
+func (config *Config) observationLogPath(rcPath string) string {
+	return config.rcCachePath(rcPath) + ".observe"
+}
+
+// appendObservation records that an .envrc evaluation consulted a file or
+// env var, for `direnv observe` (see cmd_observe.go) to call as the
+// stdlib shims report each one back.
+func appendObservation(logPath string, kind watchKind, value string) error {
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s\n", kind, value)
+	return err
+}
+
+// consumeObservations reads and removes the observation log at logPath (if
+// any), recording a watchFile or watchEnv entry on c for each path/env var
+// the stdlib shims reported this .envrc's evaluation actually depended on
+// — e.g. the flake.nix/flake.lock `use nix`/`use flake` read, or a
+// `source_env`'d file — rather than relying solely on the .envrc's own
+// mtime and a blanket watch of every previousEnv variable.
+func (c *RCCache) consumeObservations(logPath string, previousEnv Env) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	defer os.Remove(logPath)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		switch watchKind(fields[0]) {
+		case watchFile:
+			if watchErr := c.WatchFile(fields[1]); watchErr != nil {
+				logError("consumeObservations() failed to watch " + fields[1] + ": " + watchErr.Error())
+			}
+		case watchEnv:
+			c.WatchEnv(fields[1], previousEnv[fields[1]])
+		}
+	}
+}
+
+// Watches returns the watchFile entries persisted for this cache as
+// WatchedFile values, for embedding in a structured export envelope (see
+// hook_format.go and CmdExportJSON2). It reads back what the most recent
+// Save wrote, rather than c.entries, so it reflects the cache actually on
+// disk even when called from a fresh RCCache value.
+func (c *RCCache) Watches() []WatchedFile {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var watches []WatchedFile
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 || watchKind(fields[0]) != watchFile {
+			continue
+		}
+		watches = append(watches, WatchedFile{Path: fields[2], Hash: fields[1]})
+	}
+	return watches
+}
+
+// WatchEnv records that an environment variable was consulted during
+// evaluation, along with its value at the time.
+func (c *RCCache) WatchEnv(name, value string) {
+	sum := sha256.Sum256([]byte(value))
+	c.entries = append(c.entries, watchEntry{Kind: watchEnv, Key: name, Hash: hex.EncodeToString(sum[:])})
+}
+
+// SetMaxAge caps how long this cache entry may be reused, regardless of
+// whether its watched files and env vars are still unchanged. A
+// non-positive d is a no-op (no cap).
+func (c *RCCache) SetMaxAge(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	expiresAt := strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+	c.entries = append(c.entries, watchEntry{Kind: watchExpiry, Hash: expiresAt})
+}
+
+// Save persists the recorded entries to the cache log.
+func (c *RCCache) Save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, e := range c.entries {
+		if _, err = fmt.Fprintf(w, "%s %s %s\n", e.Kind, e.Hash, e.Key); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Valid replays the cache log and reports whether every recorded input
+// still hashes to the same value and no SetMaxAge cap has elapsed, meaning
+// the cached export can be reused without re-evaluating the .envrc.
+// previousEnv is the env the .envrc would be evaluated against this time;
+// watchEnv entries are checked against it rather than the process's own
+// environment, since that's what the .envrc's output can actually depend
+// on.
+func (c *RCCache) Valid(previousEnv Env) bool {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return false
+		}
+		kind, hash, key := watchKind(fields[0]), fields[1], fields[2]
+
+		switch kind {
+		case watchFile:
+			current, err := hashFileStat(key)
+			if err != nil || current != hash {
+				return false
+			}
+		case watchEnv:
+			sum := sha256.Sum256([]byte(previousEnv[key]))
+			if hex.EncodeToString(sum[:]) != hash {
+				return false
+			}
+		case watchExpiry:
+			expiresAt, err := strconv.ParseInt(hash, 10, 64)
+			if err != nil || !time.Now().Before(time.Unix(expiresAt, 0)) {
+				// This cap exists specifically to bound how long a
+				// provider-sourced secret (see providers.go) baked into
+				// the cached export can sit on disk; once it's elapsed,
+				// zeroize that export the same way providers.go zeroizes
+				// its own per-provider cache on TTL expiry, rather than
+				// leaving the secret in plaintext until some unrelated
+				// directory re-evaluation happens to overwrite it.
+				if zeroErr := zeroizeProviderCache(c.resultPath()); zeroErr != nil {
+					logError("RCCache.Valid() failed to zeroize expired cached export: " + zeroErr.Error())
+				}
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return scanner.Err() == nil
+}
+
+// resultPath is where the exported Env produced by the evaluation this
+// cache describes is stored, so a later valid cache hit can return it
+// directly instead of re-running bash.
+func (c *RCCache) resultPath() string {
+	return c.path + ".env"
+}
+
+// SaveResult persists the exported environment alongside the watch log.
+func (c *RCCache) SaveResult(env Env) error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.resultPath(), data, 0600)
+}
+
+// LoadResult returns the exported environment written by a prior
+// SaveResult call.
+func (c *RCCache) LoadResult() (Env, error) {
+	data, err := ioutil.ReadFile(c.resultPath())
+	if err != nil {
+		return nil, err
+	}
+	var env Env
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// hashFileStat hashes a file's size and modification time, which is cheap
+// enough to check on every export without reading file contents.
+func hashFileStat(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())))
+	return hex.EncodeToString(sum[:]), nil
+}
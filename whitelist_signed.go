@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultSignatureSuffix = ".envrc.sig"
+
+// tomlWhitelistSigned is the `[whitelist.signed]` table: trusted ed25519
+// public keys plus where to find a detached signature next to an .envrc.
+type tomlWhitelistSigned struct {
+	Keys            []string     `toml:"keys"`
+	SignatureSuffix string       `toml:"signature_suffix"`
+	ManifestURLs    []string     `toml:"urls"`
+	RefreshInterval tomlDuration `toml:"refresh_interval"`
+}
+
+// manifestEntry is one approved (path, sha256) pair in a signed manifest.
+type manifestEntry struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// SignedWhitelist holds the parsed `[whitelist.signed]` configuration used
+// to approve .envrc files without an interactive `direnv allow`.
+type SignedWhitelist struct {
+	Keys            []ed25519.PublicKey
+	SignatureSuffix string
+	ManifestURLs    []string
+	RefreshInterval time.Duration
+}
+
+// newSignedWhitelist decodes the TOML table into a SignedWhitelist,
+// rejecting malformed keys up front rather than failing later per-file.
+func newSignedWhitelist(toml tomlWhitelistSigned) (*SignedWhitelist, error) {
+	sw := &SignedWhitelist{
+		SignatureSuffix: toml.SignatureSuffix,
+		ManifestURLs:    toml.ManifestURLs,
+		RefreshInterval: toml.RefreshInterval.Duration,
+	}
+
+	if sw.SignatureSuffix == "" {
+		sw.SignatureSuffix = defaultSignatureSuffix
+	}
+	if sw.RefreshInterval == 0 {
+		sw.RefreshInterval = time.Hour
+	}
+
+	for _, hexKey := range toml.Keys {
+		raw, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid whitelist.signed key %q: %w", hexKey, err)
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid whitelist.signed key %q: wrong size", hexKey)
+		}
+		sw.Keys = append(sw.Keys, ed25519.PublicKey(raw))
+	}
+
+	return sw, nil
+}
+
+// findNearestEnvrc walks up from dir looking for the nearest .envrc,
+// mirroring the search FindRC performs, so a signed pre-approval can be
+// recorded before FindRC's own allow check runs.
+func findNearestEnvrc(dir string) (string, bool) {
+	for {
+		path := filepath.Join(dir, ".envrc")
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// IsApproved reports whether rcPath is approved by a detached ed25519
+// signature or by a cached signed manifest, without requiring an
+// interactive `direnv allow`.
+func (sw *SignedWhitelist) IsApproved(rcPath string, cacheDir string) (bool, error) {
+	contents, err := ioutil.ReadFile(rcPath)
+	if err != nil {
+		return false, err
+	}
+
+	if sw.verifySignatureFile(rcPath, contents) {
+		return true, nil
+	}
+
+	return sw.verifyManifest(rcPath, contents, cacheDir)
+}
+
+func (sw *SignedWhitelist) verifySignatureFile(rcPath string, contents []byte) bool {
+	sigPath := rcPath + sw.SignatureSuffix
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return false
+	}
+
+	message, err := signedEnvrcMessage(rcPath, contents)
+	if err != nil {
+		return false
+	}
+
+	for _, key := range sw.Keys {
+		if ed25519.Verify(key, message, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// signedEnvrcMessage builds the message an .envrc's detached signature must
+// cover: its absolute path plus its contents, not contents alone. Binding
+// the path matches verifyManifest, which checks entry.Path == rcPath
+// alongside the content hash; without it, a legitimately-signed, approved
+// .envrc (plus its .sig) could be copied into any other directory and
+// auto-approve there too.
+func signedEnvrcMessage(rcPath string, contents []byte) ([]byte, error) {
+	absPath, err := filepath.Abs(rcPath)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, 0, len(absPath)+1+len(contents))
+	message = append(message, absPath...)
+	message = append(message, 0)
+	message = append(message, contents...)
+	return message, nil
+}
+
+func (sw *SignedWhitelist) verifyManifest(rcPath string, contents []byte, cacheDir string) (bool, error) {
+	sum := sha256.Sum256(contents)
+	wantHash := hex.EncodeToString(sum[:])
+
+	for _, url := range sw.ManifestURLs {
+		entries, err := sw.fetchManifest(url, cacheDir)
+		if err != nil {
+			logError("verifyManifest() failed to fetch " + url + ": " + err.Error())
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Path == rcPath && entry.SHA256 == wantHash {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// manifestCachePath returns where a manifest fetched from url is cached,
+// alongside the ETag used for conditional GETs.
+func manifestCachePath(cacheDir, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, "manifests", hex.EncodeToString(sum[:]))
+}
+
+// fetchManifest returns the manifest at url, served from
+// config.CacheDir/manifests when it is within RefreshInterval and
+// otherwise re-validated with an ETag-conditional GET.
+func (sw *SignedWhitelist) fetchManifest(url, cacheDir string) ([]manifestEntry, error) {
+	path := manifestCachePath(cacheDir, url)
+	etagPath := path + ".etag"
+
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < sw.RefreshInterval {
+		return readManifestFile(path)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag, err := ioutil.ReadFile(etagPath); err == nil {
+		req.Header.Set("If-None-Match", string(etag))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if _, statErr := os.Stat(path); statErr == nil {
+			return readManifestFile(path)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		_ = os.Chtimes(path, time.Now(), time.Now())
+		return readManifestFile(path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, url)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sw.verifyManifestSignature(url, body); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, body, 0644); err != nil {
+		return nil, err
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		_ = ioutil.WriteFile(etagPath, []byte(etag), 0644)
+	}
+
+	return readManifestFile(path)
+}
+
+// verifyManifestSignature fetches the detached signature for a manifest
+// (at url+SignatureSuffix) and checks it against the configured keys.
+// A manifest URL is only useful as a trust anchor if the bytes it serves
+// are themselves signed, so an unsigned or unverifiable manifest is
+// rejected rather than trusted on content alone.
+func (sw *SignedWhitelist) verifyManifestSignature(url string, body []byte) error {
+	if len(sw.Keys) == 0 {
+		return fmt.Errorf("no whitelist.signed keys configured to verify manifest %s", url)
+	}
+
+	resp, err := http.Get(url + sw.SignatureSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to fetch manifest signature: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d fetching manifest signature", resp.StatusCode)
+	}
+
+	sig, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range sw.Keys {
+		if ed25519.Verify(key, body, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("manifest signature at %s did not verify against any configured key", url+sw.SignatureSuffix)
+}
+
+func readManifestFile(path string) ([]manifestEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
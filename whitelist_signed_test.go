@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewSignedWhitelistRejectsInvalidHex(t *testing.T) {
+	_, err := newSignedWhitelist(tomlWhitelistSigned{Keys: []string{"not-hex"}})
+	if err == nil {
+		t.Fatal("newSignedWhitelist() expected an error for invalid hex, got nil")
+	}
+}
+
+func TestNewSignedWhitelistRejectsWrongSizeKey(t *testing.T) {
+	_, err := newSignedWhitelist(tomlWhitelistSigned{Keys: []string{hex.EncodeToString([]byte("too-short"))}})
+	if err == nil {
+		t.Fatal("newSignedWhitelist() expected an error for a wrong-size key, got nil")
+	}
+}
+
+func TestNewSignedWhitelistDefaults(t *testing.T) {
+	sw, err := newSignedWhitelist(tomlWhitelistSigned{})
+	if err != nil {
+		t.Fatalf("newSignedWhitelist() error = %v", err)
+	}
+	if sw.SignatureSuffix != defaultSignatureSuffix {
+		t.Errorf("SignatureSuffix = %q, want %q", sw.SignatureSuffix, defaultSignatureSuffix)
+	}
+	if sw.RefreshInterval <= 0 {
+		t.Errorf("RefreshInterval = %v, want a positive default", sw.RefreshInterval)
+	}
+}
+
+func TestVerifySignatureFileAcceptsAValidSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	rcPath := filepath.Join(dir, ".envrc")
+	contents := []byte("export FOO=bar\n")
+	if err := os.WriteFile(rcPath, contents, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	message, err := signedEnvrcMessage(rcPath, contents)
+	if err != nil {
+		t.Fatalf("signedEnvrcMessage() error = %v", err)
+	}
+	sig := ed25519.Sign(priv, message)
+	if err := os.WriteFile(rcPath+defaultSignatureSuffix, sig, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	sw := &SignedWhitelist{Keys: []ed25519.PublicKey{pub}, SignatureSuffix: defaultSignatureSuffix}
+	if !sw.verifySignatureFile(rcPath, contents) {
+		t.Error("verifySignatureFile() = false, want true for a validly signed .envrc")
+	}
+}
+
+func TestVerifySignatureFileRejectsACopyIntoAnotherDirectory(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+
+	origDir := t.TempDir()
+	rcPath := filepath.Join(origDir, ".envrc")
+	contents := []byte("export FOO=bar\n")
+	if err := os.WriteFile(rcPath, contents, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	message, err := signedEnvrcMessage(rcPath, contents)
+	if err != nil {
+		t.Fatalf("signedEnvrcMessage() error = %v", err)
+	}
+	sig := ed25519.Sign(priv, message)
+
+	// Copy the legitimately-signed .envrc and its .sig verbatim into an
+	// unrelated directory.
+	otherDir := t.TempDir()
+	otherRcPath := filepath.Join(otherDir, ".envrc")
+	if err := os.WriteFile(otherRcPath, contents, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.WriteFile(otherRcPath+defaultSignatureSuffix, sig, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	sw := &SignedWhitelist{Keys: []ed25519.PublicKey{pub}, SignatureSuffix: defaultSignatureSuffix}
+	if sw.verifySignatureFile(otherRcPath, contents) {
+		t.Error("verifySignatureFile() = true for a copy in an unrelated directory, want false")
+	}
+}
+
+func TestVerifySignatureFileRejectsATamperedFile(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	rcPath := filepath.Join(dir, ".envrc")
+	message, err := signedEnvrcMessage(rcPath, []byte("export FOO=bar\n"))
+	if err != nil {
+		t.Fatalf("signedEnvrcMessage() error = %v", err)
+	}
+	sig := ed25519.Sign(priv, message)
+	if err := os.WriteFile(rcPath+defaultSignatureSuffix, sig, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	sw := &SignedWhitelist{Keys: []ed25519.PublicKey{pub}, SignatureSuffix: defaultSignatureSuffix}
+	if sw.verifySignatureFile(rcPath, []byte("export FOO=evil\n")) {
+		t.Error("verifySignatureFile() = true for tampered contents, want false")
+	}
+}
+
+func TestVerifySignatureFileRejectsAnUnknownKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	rcPath := filepath.Join(dir, ".envrc")
+	contents := []byte("export FOO=bar\n")
+	message, err := signedEnvrcMessage(rcPath, contents)
+	if err != nil {
+		t.Fatalf("signedEnvrcMessage() error = %v", err)
+	}
+	sig := ed25519.Sign(priv, message)
+	if err := os.WriteFile(rcPath+defaultSignatureSuffix, sig, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	sw := &SignedWhitelist{Keys: []ed25519.PublicKey{otherPub}, SignatureSuffix: defaultSignatureSuffix}
+	if sw.verifySignatureFile(rcPath, contents) {
+		t.Error("verifySignatureFile() = true against a key that didn't sign it, want false")
+	}
+}
+
+func TestFetchManifestVerifiesAndCachesWithETag(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+
+	entries := []manifestEntry{{Path: "/repo/.envrc", SHA256: "deadbeef"}}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	sig := ed25519.Sign(priv, body)
+
+	requests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(body)
+	})
+	mux.HandleFunc("/manifest.json.sig", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(sig)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sw := &SignedWhitelist{Keys: []ed25519.PublicKey{pub}, SignatureSuffix: ".sig"}
+	cacheDir := t.TempDir()
+	url := server.URL + "/manifest.json"
+
+	got, err := sw.fetchManifest(url, cacheDir)
+	if err != nil {
+		t.Fatalf("fetchManifest() error = %v", err)
+	}
+	if len(got) != 1 || got[0] != entries[0] {
+		t.Fatalf("fetchManifest() = %+v, want %+v", got, entries)
+	}
+
+	// Force past the cache-file freshness window without waiting out
+	// RefreshInterval, to exercise the conditional-GET/304 path.
+	cachePath := manifestCachePath(cacheDir, url)
+	stale := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(cachePath, stale, stale); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+
+	got, err = sw.fetchManifest(url, cacheDir)
+	if err != nil {
+		t.Fatalf("fetchManifest() (revalidate) error = %v", err)
+	}
+	if len(got) != 1 || got[0] != entries[0] {
+		t.Fatalf("fetchManifest() (revalidate) = %+v, want %+v", got, entries)
+	}
+	if requests != 2 {
+		t.Fatalf("server received %d requests, want 2 (initial fetch + conditional revalidate)", requests)
+	}
+}
+
+func TestFetchManifestRejectsAnInvalidSignature(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"path":"/repo/.envrc","sha256":"deadbeef"}]`))
+	})
+	mux.HandleFunc("/manifest.json.sig", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not-a-valid-signature"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sw := &SignedWhitelist{Keys: []ed25519.PublicKey{pub}, SignatureSuffix: ".sig"}
+	if _, err := sw.fetchManifest(server.URL+"/manifest.json", t.TempDir()); err == nil {
+		t.Fatal("fetchManifest() expected an error for a manifest with an invalid signature, got nil")
+	}
+}